@@ -0,0 +1,38 @@
+package plugins
+
+import "strings"
+
+// extractHeaderBlock pulls a (possibly multi-line) raw commit header named
+// key out of content, per git's header-continuation encoding where
+// continuation lines are indented by a single space. It returns the
+// dedented value (continuation lines joined by "\n", leading "key " and
+// per-line leading space stripped) and the content with that header block
+// removed, so callers can reconstruct the exact bytes git originally signed.
+func extractHeaderBlock(content, key string) (value string, rest string, found bool) {
+	lines := strings.SplitAfter(content, "\n")
+	var headerLines []string
+	var other []string
+
+	i := 0
+	for i < len(lines) {
+		trimmed := strings.TrimSuffix(lines[i], "\n")
+		if strings.HasPrefix(trimmed, key+" ") {
+			headerLines = append(headerLines, strings.TrimPrefix(trimmed, key+" "))
+			i++
+			for i < len(lines) {
+				cont := strings.TrimSuffix(lines[i], "\n")
+				if !strings.HasPrefix(cont, " ") {
+					break
+				}
+				headerLines = append(headerLines, strings.TrimPrefix(cont, " "))
+				i++
+			}
+			found = true
+			continue
+		}
+		other = append(other, lines[i])
+		i++
+	}
+
+	return strings.Join(headerLines, "\n"), strings.Join(other, ""), found
+}
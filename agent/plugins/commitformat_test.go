@@ -0,0 +1,60 @@
+package plugins
+
+import "testing"
+
+func TestExtractHeaderBlockNotPresent(t *testing.T) {
+	content := "tree abc123\nauthor A <a@example.com> 0 +0000\ncommitter A <a@example.com> 0 +0000\n\nmessage\n"
+
+	value, rest, found := extractHeaderBlock(content, "gpgsig")
+	if found {
+		t.Fatalf("expected gpgsig not to be found, got value %q", value)
+	}
+	if rest != content {
+		t.Fatalf("rest should be unchanged when header is absent:\n got:  %q\n want: %q", rest, content)
+	}
+}
+
+func TestExtractHeaderBlockMultiLine(t *testing.T) {
+	content := "tree abc123\n" +
+		"author A <a@example.com> 0 +0000\n" +
+		"committer A <a@example.com> 0 +0000\n" +
+		"gpgsig -----BEGIN SSH SIGNATURE-----\n" +
+		" line one\n" +
+		" line two\n" +
+		" -----END SSH SIGNATURE-----\n" +
+		"\n" +
+		"message\n"
+
+	value, rest, found := extractHeaderBlock(content, "gpgsig")
+	if !found {
+		t.Fatalf("expected gpgsig header to be found")
+	}
+
+	wantValue := "-----BEGIN SSH SIGNATURE-----\nline one\nline two\n-----END SSH SIGNATURE-----"
+	if value != wantValue {
+		t.Fatalf("value mismatch:\n got:  %q\n want: %q", value, wantValue)
+	}
+
+	wantRest := "tree abc123\n" +
+		"author A <a@example.com> 0 +0000\n" +
+		"committer A <a@example.com> 0 +0000\n" +
+		"\n" +
+		"message\n"
+	if rest != wantRest {
+		t.Fatalf("rest mismatch:\n got:  %q\n want: %q", rest, wantRest)
+	}
+}
+
+func TestExtractHeaderBlockPreservesOtherHeaders(t *testing.T) {
+	content := "tree abc123\nparent def456\ngpgsig -----BEGIN PGP SIGNATURE-----\n sig-body\n -----END PGP SIGNATURE-----\nauthor A <a@example.com> 0 +0000\n\nmessage\n"
+
+	_, rest, found := extractHeaderBlock(content, "gpgsig")
+	if !found {
+		t.Fatalf("expected gpgsig header to be found")
+	}
+
+	want := "tree abc123\nparent def456\nauthor A <a@example.com> 0 +0000\n\nmessage\n"
+	if rest != want {
+		t.Fatalf("rest mismatch:\n got:  %q\n want: %q", rest, want)
+	}
+}
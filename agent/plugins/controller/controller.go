@@ -0,0 +1,262 @@
+// Package controller implements a small control-plane for plugin version
+// orchestration: a coordinator pins a target commit per cohort, agents
+// long-poll for their cohort's current pin instead of independently
+// polling "origin/master", and the coordinator can stage canary rollouts
+// (5% -> 25% -> 100%) with an automatic halt when an agent's reported
+// failure metrics spike.
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pin is the target version a coordinator wants a cohort of agents to run.
+type Pin struct {
+	Version           string `json:"version"`
+	Cohort            string `json:"cohort"`
+	RolloutPercent    int    `json:"rollout_percent"`               // 0-100; agents outside the rollout keep the previous pin
+	MinUpdateInterval int64  `json:"min_update_interval,omitempty"` // seconds between update attempts; 0 = agent default
+}
+
+// AgentStatus is what an agent last reported about itself.
+type AgentStatus struct {
+	AgentID         string    `json:"agent_id"`
+	Cohort          string    `json:"cohort"`
+	CurrentVersion  string    `json:"current_version"`
+	TargetVersion   string    `json:"target_version"`
+	LastUpdateError string    `json:"last_update_error,omitempty"`
+	LastUpdateAt    time.Time `json:"last_update_at"`
+}
+
+// StatusResponse is returned by GET /plugin/status.
+type StatusResponse struct {
+	CurrentVersion  string    `json:"current_version"`
+	TargetVersion   string    `json:"target_version"`
+	LastUpdateError string    `json:"last_update_error,omitempty"`
+	LastUpdateAt    time.Time `json:"last_update_at"`
+}
+
+// defaultFailureRateThreshold is used when Server.FailureRateThreshold is
+// not set. ReportStatus halts a cohort's rollout automatically when the
+// fraction of the cohort's agents whose last reported status carries a
+// LastUpdateError exceeds the threshold.
+const defaultFailureRateThreshold = 0.1
+
+// Server is the control-plane HTTP surface. It's safe for concurrent use.
+type Server struct {
+	mu                   sync.Mutex
+	pins                 map[string]*Pin // cohort -> current pin
+	previousVersion      map[string]string
+	statuses             map[string]AgentStatus // agentID -> last reported status
+	FailureRateThreshold float64
+}
+
+// NewServer returns an empty Server with no cohorts pinned.
+func NewServer() *Server {
+	return &Server{
+		pins:                 make(map[string]*Pin),
+		previousVersion:      make(map[string]string),
+		statuses:             make(map[string]AgentStatus),
+		FailureRateThreshold: defaultFailureRateThreshold,
+	}
+}
+
+// Pin sets (or replaces) the target pin for a cohort.
+func (s *Server) Pin(p Pin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.pins[p.Cohort]; ok && existing.Version != p.Version {
+		s.previousVersion[p.Cohort] = existing.Version
+	}
+	cp := p
+	s.pins[p.Cohort] = &cp
+}
+
+// Rollback reverts a cohort to the version it was pinned to before the
+// current pin.
+func (s *Server) Rollback(cohort string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.previousVersion[cohort]
+	if !ok {
+		return fmt.Errorf("no previous version recorded for cohort %q", cohort)
+	}
+	s.pins[cohort] = &Pin{Version: prev, Cohort: cohort, RolloutPercent: 100}
+	return nil
+}
+
+// PinFor resolves the pin that agentID (in cohort) should currently follow,
+// taking RolloutPercent canarying into account: an agent outside the
+// rollout percentage keeps running the cohort's previous version.
+func (s *Server) PinFor(cohort, agentID string) *Pin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pin, ok := s.pins[cohort]
+	if !ok {
+		return nil
+	}
+	if pin.RolloutPercent >= 100 || inRollout(agentID, pin.RolloutPercent) {
+		return pin
+	}
+
+	prev, ok := s.previousVersion[cohort]
+	if !ok {
+		return pin
+	}
+	return &Pin{Version: prev, Cohort: cohort, RolloutPercent: 100}
+}
+
+// inRollout deterministically buckets agentID into [0,100) so repeated
+// polls from the same agent land on the same side of a given percentage.
+func inRollout(agentID string, percent int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(agentID))
+	return int(h.Sum32()%100) < percent
+}
+
+// ReportStatus records an agent's self-reported status and, if its failure
+// rate for the cohort crosses FailureRateThreshold, halts that cohort's
+// rollout by pinning it back to the previous version.
+func (s *Server) ReportStatus(st AgentStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statuses[st.AgentID] = st
+	if st.LastUpdateError == "" {
+		return
+	}
+
+	total, failing := 0, 0
+	for _, other := range s.statuses {
+		if other.Cohort != st.Cohort {
+			continue
+		}
+		total++
+		if other.LastUpdateError != "" {
+			failing++
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	threshold := s.FailureRateThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureRateThreshold
+	}
+	if float64(failing)/float64(total) > threshold {
+		if prev, ok := s.previousVersion[st.Cohort]; ok {
+			s.pins[st.Cohort] = &Pin{Version: prev, Cohort: st.Cohort, RolloutPercent: 100}
+		}
+	}
+}
+
+// RegisterRoutes wires the control-plane handlers onto mux.
+func (s *Server) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/plugin/pin", s.handlePin)
+	mux.HandleFunc("/plugin/status", s.handleStatus)
+	mux.HandleFunc("/plugin/rollback", s.handleRollback)
+	mux.HandleFunc("/plugin/poll", s.handlePoll)
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var p Pin
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Cohort == "" {
+		http.Error(w, "cohort is required", http.StatusBadRequest)
+		return
+	}
+	s.Pin(p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	agentID := r.URL.Query().Get("agent_id")
+
+	s.mu.Lock()
+	st, ok := s.statuses[agentID]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown agent", http.StatusNotFound)
+		return
+	}
+
+	resp := StatusResponse{
+		CurrentVersion:  st.CurrentVersion,
+		TargetVersion:   st.TargetVersion,
+		LastUpdateError: st.LastUpdateError,
+		LastUpdateAt:    st.LastUpdateAt,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Cohort string `json:"cohort"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Rollback(req.Cohort); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// longPollTimeout bounds how long handlePoll holds a request open waiting
+// for the cohort's pin to change.
+const longPollTimeout = 60 * time.Second
+
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	cohort := r.URL.Query().Get("cohort")
+	agentID := r.URL.Query().Get("agent_id")
+	knownVersion := r.URL.Query().Get("known_version")
+	if cohort == "" || agentID == "" {
+		http.Error(w, "cohort and agent_id are required", http.StatusBadRequest)
+		return
+	}
+
+	if statusJSON := r.Header.Get("X-Satori-Status"); statusJSON != "" {
+		var st AgentStatus
+		if err := json.Unmarshal([]byte(statusJSON), &st); err == nil {
+			s.ReportStatus(st)
+		}
+	}
+
+	deadline := time.Now().Add(longPollTimeout)
+	for {
+		pin := s.PinFor(cohort, agentID)
+		if pin == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if pin.Version != knownVersion || time.Now().After(deadline) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(pin)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/leancloud/satori/agent/g"
+	"github.com/leancloud/satori/agent/plugins/controller"
+)
+
+var cohortFlag = flag.String("cohort", "default", "cohort label to report to the plugin controller")
+
+// controllerClient long-polls a plugins/controller Server for this agent's
+// pinned plugin version, replacing the old "poll and fetch origin/master"
+// behavior. The existing updateInflight/lastPluginUpdate throttle still
+// applies, but its interval is no longer hardcoded: RunControllerDrivenUpdates
+// applies Pin.MinUpdateInterval via SetMinUpdateInterval before every
+// UpdatePlugin call, so the controller can tune it without an agent restart.
+type controllerClient struct {
+	baseURL string
+	agentID string
+	cohort  string
+}
+
+func newControllerClient(baseURL, agentID string) *controllerClient {
+	return &controllerClient{baseURL: baseURL, agentID: agentID, cohort: *cohortFlag}
+}
+
+// Poll blocks (bounded by ctx) until the controller returns a pin, i.e. a
+// new or still-current target version for this agent's cohort.
+func (c *controllerClient) Poll(ctx context.Context, knownVersion string, lastStatus *controller.AgentStatus) (*controller.Pin, error) {
+	q := url.Values{}
+	q.Set("cohort", c.cohort)
+	q.Set("agent_id", c.agentID)
+	q.Set("known_version", knownVersion)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/plugin/poll?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if lastStatus != nil {
+		statusJSON, err := json.Marshal(lastStatus)
+		if err == nil {
+			req.Header.Set("X-Satori-Status", string(statusJSON))
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("controller poll failed: %s", resp.Status)
+	}
+
+	var pin controller.Pin
+	if err := json.NewDecoder(resp.Body).Decode(&pin); err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+var (
+	lastUpdateAt  time.Time
+	lastUpdateErr string
+)
+
+// RunControllerDrivenUpdates replaces the agent's independent "poll origin
+// every 300s" loop with a long-poll against Plugin.ControllerURL. It keeps
+// calling UpdatePlugin(pin.Version) whenever the controller hands back a
+// new target, until ctx is canceled.
+func RunControllerDrivenUpdates(ctx context.Context) error {
+	cfg := g.Config().Plugin
+	if cfg.ControllerURL == "" {
+		return fmt.Errorf("Plugin.ControllerURL not configured")
+	}
+
+	hostname, err := g.Hostname()
+	if err != nil {
+		return err
+	}
+	client := newControllerClient(cfg.ControllerURL, hostname)
+
+	knownVersion, _ := GetCurrentPluginVersion()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var status *controller.AgentStatus
+		if !lastUpdateAt.IsZero() {
+			status = &controller.AgentStatus{
+				AgentID:         hostname,
+				Cohort:          client.cohort,
+				CurrentVersion:  knownVersion,
+				LastUpdateError: lastUpdateErr,
+				LastUpdateAt:    lastUpdateAt,
+			}
+		}
+
+		pin, err := client.Poll(ctx, knownVersion, status)
+		if err != nil {
+			log.Println("controller poll failed:", err.Error())
+			reportFailure("controller-poll-fail", err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if pin == nil {
+			// No pin for this cohort yet; handlePoll returns immediately in
+			// that case, so back off instead of hammering the controller.
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if pin.Version == knownVersion {
+			// The long poll timed out with the pin unchanged.
+			continue
+		}
+
+		SetMinUpdateInterval(pin.MinUpdateInterval)
+
+		if err := UpdatePlugin(pin.Version); err != nil {
+			lastUpdateErr = err.Error()
+			lastUpdateAt = time.Now()
+			// knownVersion stays put, so without a backoff here the next
+			// iteration would immediately get handed the same pin again
+			// (e.g. while the update-too-recent throttle is in effect) and
+			// busy-loop against the controller until it clears.
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		lastUpdateErr = ""
+		knownVersion = pin.Version
+		lastUpdateAt = time.Now()
+	}
+}
@@ -0,0 +1,57 @@
+package plugins
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// verifyPGPSignature verifies a git commit signed with `gpg.format=openpgp`
+// by shelling out to `gpg --verify` against a configured keyring, rather
+// than reimplementing OpenPGP parsing in-process.
+func verifyPGPSignature(content string, keyringPath string) error {
+	armored, payload, found := extractHeaderBlock(content, "gpgsig")
+	if !found {
+		return fmt.Errorf("no gpgsig header present")
+	}
+	if !strings.Contains(armored, "BEGIN PGP SIGNATURE") {
+		return fmt.Errorf("gpgsig header is not a PGP signature")
+	}
+	if keyringPath == "" {
+		return fmt.Errorf("Plugin.GPGKeyring not configured")
+	}
+
+	dataFile, err := ioutil.TempFile("", "satori-commit-payload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dataFile.Name())
+	if _, err := dataFile.WriteString(payload); err != nil {
+		dataFile.Close()
+		return err
+	}
+	dataFile.Close()
+
+	sigFile, err := ioutil.TempFile("", "satori-commit-sig-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile.Name())
+	if _, err := sigFile.WriteString(armored + "\n"); err != nil {
+		sigFile.Close()
+		return err
+	}
+	sigFile.Close()
+
+	cmd := exec.Command("gpg", "--batch", "--no-tty",
+		"--no-default-keyring", "--keyring", keyringPath,
+		"--verify", sigFile.Name(), dataFile.Name())
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gpg --verify failed: %s\n%s", err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/leancloud/satori/agent/g"
+)
+
+// PluginRepo wraps a go-git repository checked out at a local path. It
+// replaces the previous implementation that shelled out to a `git` binary
+// (and `timeout(1)`), which made the agent unusable on hosts that don't
+// have those on PATH.
+type PluginRepo struct {
+	path string
+	repo *git.Repository
+}
+
+// OpenOrInitPluginRepo opens the plugin repo at path, creating it (and
+// wiring up the "origin" remote) if it doesn't exist yet. It never fetches.
+func OpenOrInitPluginRepo(path string, remote string) (*PluginRepo, error) {
+	repo, err := git.PlainOpen(path)
+	if err == git.ErrRepositoryNotExists {
+		log.Println("Plugin repo does not exist, creating one")
+		repo, err = git.PlainInit(path, false)
+		if err != nil {
+			return nil, fmt.Errorf("can't init plugin repo: %s", err)
+		}
+		if _, err := repo.CreateRemote(&config.RemoteConfig{
+			Name: "origin",
+			URLs: []string{remote},
+		}); err != nil {
+			os.RemoveAll(path)
+			return nil, fmt.Errorf("can't set repo remote, aborting: %s", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("can't open plugin repo: %s", err)
+	}
+
+	return &PluginRepo{path: path, repo: repo}, nil
+}
+
+// Fetch fetches "origin" using the auth method built from the configured
+// Plugin.Transport, bounded by ctx instead of an external timeout(1).
+func (r *PluginRepo) Fetch(ctx context.Context) error {
+	auth, err := buildAuthMethod(g.Config().Plugin.Transport)
+	if err != nil {
+		return fmt.Errorf("can't build git transport auth: %s", err)
+	}
+
+	err = r.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("update plugins by fetch error: %s", err)
+	}
+	return nil
+}
+
+// Checkout hard-resets the worktree to ref, mirroring `git reset --hard`.
+func (r *PluginRepo) Checkout(ref string) error {
+	hash, err := r.Resolve(ref)
+	if err != nil {
+		return fmt.Errorf("can't resolve ref %q: %s", ref, err)
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err := wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("git reset --hard failed: %s", err)
+	}
+	return nil
+}
+
+// SetHead advances HEAD to hash without touching the worktree, so callers
+// that have already re-materialized the changed files themselves (e.g. an
+// incremental sync) don't pay for a second full checkout just to move the
+// ref forward.
+func (r *PluginRepo) SetHead(hash plumbing.Hash) error {
+	ref := plumbing.NewHashReference(plumbing.HEAD, hash)
+	if err := r.repo.Storer.SetReference(ref); err != nil {
+		return fmt.Errorf("can't advance HEAD to %s: %s", hash, err)
+	}
+	return nil
+}
+
+// ResolveHead returns the full hash HEAD currently points to.
+func (r *PluginRepo) ResolveHead() (string, error) {
+	head, err := r.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// Resolve resolves a ref (branch, tag, "origin/master", short or full hash)
+// to a commit hash.
+func (r *PluginRepo) Resolve(ref string) (plumbing.Hash, error) {
+	h, err := r.repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *h, nil
+}
+
+// CatObject returns the raw, decompressed content of the object named by
+// ref, equivalent to `git cat-file -p <ref>`. For a commit this includes
+// any custom header lines (e.g. "satori-sign"), since it reads the encoded
+// object directly rather than going through go-git's parsed Commit type.
+func (r *PluginRepo) CatObject(ref string) (string, error) {
+	hash, err := r.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve ref %q: %s", ref, err)
+	}
+
+	obj, err := r.repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return "", fmt.Errorf("can't get content of desired commit: %s", err)
+	}
+
+	reader, err := obj.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// FileAt returns the contents of path as it existed at ref.
+func (r *PluginRepo) FileAt(ref string, path string) (string, error) {
+	hash, err := r.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve ref %q: %s", ref, err)
+	}
+
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := commit.File(path)
+	if err != nil {
+		return "", err
+	}
+	return f.Contents()
+}
+
+// LastCommitTouching returns the most recent commit reachable from ref that
+// modified path, equivalent to `git rev-list -1 <ref> <path>`.
+func (r *PluginRepo) LastCommitTouching(ref string, path string) (string, error) {
+	hash, err := r.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve ref %q: %s", ref, err)
+	}
+
+	cIter, err := r.repo.Log(&git.LogOptions{From: hash, PathFilter: func(p string) bool { return p == path }})
+	if err != nil {
+		return "", err
+	}
+	defer cIter.Close()
+
+	commit, err := cIter.Next()
+	if err != nil {
+		return "", fmt.Errorf("can't get most recent commit hash of key file: %s", err)
+	}
+	return commit.Hash.String(), nil
+}
+
+// buildAuthMethod turns a Plugin.Transport config block into a go-git
+// transport.AuthMethod. It returns a nil AuthMethod (no error) when nothing
+// is configured, which is valid for unauthenticated/public remotes.
+func buildAuthMethod(cfg g.PluginTransportConfig) (transport.AuthMethod, error) {
+	switch {
+	case cfg.SSHKeyFile != "":
+		auth, err := gitssh.NewPublicKeysFromFile(cfg.SSHUser, cfg.SSHKeyFile, cfg.SSHKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("can't load ssh key %s: %s", cfg.SSHKeyFile, err)
+		}
+		if err := configureHostKeyCallback(&auth.HostKeyCallbackHelper, cfg); err != nil {
+			return nil, err
+		}
+		return auth, nil
+	case cfg.UseSSHAgent:
+		auth, err := gitssh.NewSSHAgentAuth(cfg.SSHUser)
+		if err != nil {
+			return nil, fmt.Errorf("can't use ssh-agent: %s", err)
+		}
+		if err := configureHostKeyCallback(&auth.HostKeyCallbackHelper, cfg); err != nil {
+			return nil, err
+		}
+		return auth, nil
+	case cfg.Token != "":
+		return &githttp.BasicAuth{Username: cfg.Username, Password: cfg.Token}, nil
+	case cfg.Username != "" && cfg.Password != "":
+		return &githttp.BasicAuth{Username: cfg.Username, Password: cfg.Password}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// configureHostKeyCallback sets the host key check on the
+// gitssh.HostKeyCallbackHelper embedded in both *gitssh.PublicKeys (key-file
+// auth) and *gitssh.PublicKeysCallback (ssh-agent auth), so it works for
+// either.
+func configureHostKeyCallback(helper *gitssh.HostKeyCallbackHelper, cfg g.PluginTransportConfig) error {
+	if cfg.InsecureSkipVerify {
+		helper.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return nil
+	}
+	if cfg.KnownHostsFile == "" {
+		return nil
+	}
+	cb, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return fmt.Errorf("can't load known_hosts file %s: %s", cfg.KnownHostsFile, err)
+	}
+	helper.HostKeyCallback = cb
+	return nil
+}
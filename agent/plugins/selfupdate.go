@@ -0,0 +1,359 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kardianos/osext"
+	"github.com/toolkits/file"
+
+	"github.com/leancloud/satori/agent/g"
+)
+
+// selfUpdateProbeFlag is set on the canary process re-exec'd by TrySelfUpdate,
+// carrying the parent's pid so the canary can find the pipe it inherited on
+// fd 3 and report back whether it came up healthy.
+var selfUpdateProbeFlag = flag.Int("self-update-probe", 0, "internal: pid of the parent waiting on this canary process")
+
+// selfUpdateProbePortFlag carries the ephemeral port probeCanary reserved
+// for the canary's health listener. The parent is still bound to the
+// configured production port, so the canary can't probe itself there;
+// main() must bind to ProbePort() instead of its usual port whenever
+// IsSelfUpdateProbe() is true.
+var selfUpdateProbePortFlag = flag.Int("self-update-probe-port", 0, "internal: port the canary should bind its health listener on")
+
+var selfUpdateRollbackFlag = flag.Bool("rollback", false, "roll back to the previous satori-agent binary and exit")
+
+// TrySelfUpdate implements a two-phase self update:
+//
+// Phase 1: if the binary dropped in Plugin.CheckoutPath differs from the
+// running binary, verify its signature, then fork+exec it in "canary" mode
+// (--self-update-probe=<pid>) and wait up to SelfUpdate.ProbeTimeout for it
+// to report itself healthy over an inherited pipe.
+//
+// Phase 2: only if the canary reports healthy does this process retire its
+// own binary (renamed aside, not deleted, so --rollback can restore it) and
+// copy the new one into place before re-exec'ing. Any failure along the way
+// deletes the canary binary and leaves the running process untouched.
+func TrySelfUpdate() error {
+	debug := g.Config().Debug
+	cfg := g.Config()
+	if !cfg.SelfUpdate.Enabled {
+		return nil
+	}
+
+	selfPath, err := osext.Executable()
+	if err != nil {
+		return err
+	}
+
+	newPath := path.Join(cfg.Plugin.CheckoutPath, "satori-agent")
+	if !file.IsExist(newPath) {
+		if debug {
+			log.Println("SelfUpdate: Can't find new binary on path:", newPath)
+		}
+		return nil
+	}
+
+	selfHash, err := sha256File(selfPath)
+	if err != nil {
+		return err
+	}
+	newHash, err := sha256File(newPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(selfHash[:], newHash[:]) {
+		return nil
+	}
+
+	if len(cfg.Plugin.SigningKeys) > 0 {
+		if err := verifySelfUpdateArtifact(newPath, newHash, cfg.Plugin.SigningKeys); err != nil {
+			reportFailure("selfupdate-signature-fail", err.Error())
+			os.Remove(newPath)
+			return err
+		}
+	} else {
+		log.Println("Signing keys not configured, self-update artifact signature check skipped")
+	}
+
+	probeTimeout := cfg.SelfUpdate.ProbeTimeout
+	if probeTimeout <= 0 {
+		probeTimeout = 30 * time.Second
+	}
+
+	if err := probeCanary(newPath, probeTimeout); err != nil {
+		reportFailure("selfupdate-rollback", err.Error())
+		os.Remove(newPath)
+		return fmt.Errorf("self-update canary failed health check, rolled back: %s", err)
+	}
+
+	if err := promoteBinary(selfPath, newPath, selfHash, cfg.SelfUpdate.KeepVersions); err != nil {
+		reportFailure("selfupdate-rollback", err.Error())
+		os.Remove(newPath)
+		return err
+	}
+
+	log.Println("SelfUpdate triggered, restarting")
+	syscall.Exec(selfPath, os.Args, os.Environ())
+
+	return fmt.Errorf("can't do exec")
+}
+
+func verifySelfUpdateArtifact(artifactPath string, digest [sha256.Size]byte, validKeys []string) error {
+	sigPath := artifactPath + ".sig"
+	sigB64, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("can't read self-update signature %s: %s", sigPath, err)
+	}
+	return verifyDigestSignature(hex.EncodeToString(digest[:]), strings.TrimSpace(string(sigB64)), validKeys)
+}
+
+// reserveProbePort picks a free loopback port for the canary's health
+// listener by briefly binding to port 0 and reading back what the kernel
+// assigned, then releasing it. This is inherently racy (something else can
+// grab the port before the canary binds it), but it's what lets the canary
+// probe itself without fighting the parent for the production port it's
+// still holding.
+func reserveProbePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// probeCanary forks+execs newPath with --self-update-probe=<our pid>,
+// --self-update-probe-port=<an ephemeral port>, and a pipe write-end on fd
+// 3, then waits for the canary to either write a single byte to signal
+// success or for timeout/exit to signal failure.
+//
+// The canary is the same binary as the running agent and would otherwise
+// try to bind the same production listen port the parent is still holding;
+// main() must check IsSelfUpdateProbe() and bind ProbePort() instead
+// whenever it's set, so the canary's /health check hits its own listener
+// rather than racing the parent for one port.
+func probeCanary(newPath string, timeout time.Duration) error {
+	probePort, err := reserveProbePort()
+	if err != nil {
+		return fmt.Errorf("can't reserve a probe port: %s", err)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+
+	cmd := exec.Command(newPath,
+		fmt.Sprintf("--self-update-probe=%d", os.Getpid()),
+		fmt.Sprintf("--self-update-probe-port=%d", probePort))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{pw}
+
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := pr.Read(buf)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		pw.Close()
+		cmd.Process.Kill()
+		<-done
+		if err != nil {
+			return fmt.Errorf("canary closed pipe without signaling health: %s", err)
+		}
+		return nil
+	case err := <-done:
+		pw.Close()
+		return fmt.Errorf("canary exited before reporting healthy: %s", err)
+	case <-time.After(timeout):
+		pw.Close()
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("canary did not report healthy within %s", timeout)
+	}
+}
+
+// IsSelfUpdateProbe reports whether this process was launched as a
+// self-update canary (--self-update-probe=<pid>). main() must consult this
+// before binding its normal listen port: a canary has to bind ProbePort()
+// instead, since the parent is still holding the production port.
+func IsSelfUpdateProbe() bool {
+	return *selfUpdateProbeFlag != 0
+}
+
+// ProbePort returns the ephemeral port probeCanary reserved for this
+// canary's health listener. Only meaningful when IsSelfUpdateProbe() is
+// true.
+func ProbePort() int {
+	return *selfUpdateProbePortFlag
+}
+
+// RunSelfUpdateProbeIfRequested should be called early in main(), after
+// main() has bound its listener to ProbePort() (see IsSelfUpdateProbe). If
+// this process was launched as a canary (--self-update-probe=<pid>), it
+// hits its own /health endpoint on that port and signals the parent over
+// the inherited fd 3, then returns normally so the process continues
+// serving as usual.
+func RunSelfUpdateProbeIfRequested() {
+	if !IsSelfUpdateProbe() {
+		return
+	}
+	healthURL := fmt.Sprintf("http://127.0.0.1:%d/health", *selfUpdateProbePortFlag)
+
+	pw := os.NewFile(3, "self-update-probe-pipe")
+	if pw == nil {
+		return
+	}
+	defer pw.Close()
+
+	ok := false
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(healthURL)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			resp.Body.Close()
+			ok = true
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(time.Second)
+	}
+
+	if ok {
+		pw.Write([]byte{1})
+	}
+}
+
+// promoteBinary retires selfPath to selfPath.<sha256 of selfPath's own
+// content>, copies newPath to selfPath (newPath itself is left in place),
+// and prunes old retired binaries beyond keepVersions.
+func promoteBinary(selfPath, newPath string, selfHash [sha256.Size]byte, keepVersions int) error {
+	retiredPath := selfPath + "." + hex.EncodeToString(selfHash[:])
+
+	if file.IsExist(retiredPath) {
+		os.Remove(retiredPath)
+	}
+	if err := os.Rename(selfPath, retiredPath); err != nil {
+		return fmt.Errorf("can't retire current binary: %s", err)
+	}
+	if err := copyFile(newPath, selfPath); err != nil {
+		os.Rename(retiredPath, selfPath)
+		return fmt.Errorf("can't install new binary: %s", err)
+	}
+	if err := os.Chmod(selfPath, 0755); err != nil {
+		return err
+	}
+
+	pruneRetiredBinaries(selfPath, keepVersions)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func retiredBinaries(selfPath string) []string {
+	matches, _ := filepath.Glob(selfPath + ".*")
+	sort.Slice(matches, func(i, j int) bool {
+		fi, _ := os.Stat(matches[i])
+		fj, _ := os.Stat(matches[j])
+		if fi == nil || fj == nil {
+			return false
+		}
+		return fi.ModTime().After(fj.ModTime())
+	})
+	return matches
+}
+
+func pruneRetiredBinaries(selfPath string, keepVersions int) {
+	if keepVersions <= 0 {
+		keepVersions = 3
+	}
+	matches := retiredBinaries(selfPath)
+	for i := keepVersions; i < len(matches); i++ {
+		os.Remove(matches[i])
+	}
+}
+
+// Rollback implements `satori-agent --rollback`: it swaps the running
+// binary with the most recently retired one. Callers should exec or exit
+// after this returns, same as a normal self-update re-exec.
+func Rollback() error {
+	selfPath, err := osext.Executable()
+	if err != nil {
+		return err
+	}
+
+	matches := retiredBinaries(selfPath)
+	if len(matches) == 0 {
+		return fmt.Errorf("no retired satori-agent binaries to roll back to")
+	}
+	previous := matches[0]
+
+	currentHash, err := sha256File(selfPath)
+	if err != nil {
+		return err
+	}
+	retiredPath := selfPath + "." + hex.EncodeToString(currentHash[:])
+
+	if err := os.Rename(selfPath, retiredPath); err != nil {
+		return fmt.Errorf("can't retire current binary: %s", err)
+	}
+	if err := os.Rename(previous, selfPath); err != nil {
+		os.Rename(retiredPath, selfPath)
+		return fmt.Errorf("can't restore previous binary: %s", err)
+	}
+
+	log.Println("Rolled back to", previous)
+	return nil
+}
+
+// ShouldRollback reports whether --rollback was passed on the command line.
+func ShouldRollback() bool {
+	return *selfUpdateRollbackFlag
+}
@@ -0,0 +1,399 @@
+package plugins
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/leancloud/satori/agent/g"
+)
+
+const snapshotFileName = ".satori-snapshot.json"
+
+// FileState is the recorded state of a single plugin-tree file.
+type FileState struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"`
+}
+
+// Snapshot maps a checkout-relative path to its last-known-good state.
+type Snapshot map[string]FileState
+
+func snapshotPath(checkoutPath string) string {
+	return filepath.Join(checkoutPath, snapshotFileName)
+}
+
+// loadSnapshot reads the persisted snapshot, returning an empty Snapshot if
+// none exists yet.
+func loadSnapshot(checkoutPath string) (Snapshot, error) {
+	data, err := ioutil.ReadFile(snapshotPath(checkoutPath))
+	if os.IsNotExist(err) {
+		return Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func saveSnapshot(checkoutPath string, s Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(snapshotPath(checkoutPath), data, 0644)
+}
+
+// computeSnapshot walks checkoutPath and hashes every regular file except
+// the snapshot file and the .git directory.
+func computeSnapshot(checkoutPath string) (Snapshot, error) {
+	s := Snapshot{}
+	err := filepath.Walk(checkoutPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(checkoutPath, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == snapshotFileName {
+			return nil
+		}
+
+		sum, err := sha256File(p)
+		if err != nil {
+			return err
+		}
+		s[rel] = FileState{
+			SHA256: hex.EncodeToString(sum[:]),
+			Size:   info.Size(),
+			MTime:  info.ModTime().Unix(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// snapshotAfterCheckout recomputes and persists the snapshot; called after
+// every successful checkoutCommit.
+func snapshotAfterCheckout(checkoutPath string) (Snapshot, error) {
+	s, err := computeSnapshot(checkoutPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't compute plugin snapshot: %s", err)
+	}
+	if err := saveSnapshot(checkoutPath, s); err != nil {
+		return nil, fmt.Errorf("can't persist plugin snapshot: %s", err)
+	}
+	return s, nil
+}
+
+var (
+	snapshotMu     sync.RWMutex
+	currentSnap    Snapshot
+	tainted        bool
+	tamperSyncLock sync.Mutex
+)
+
+// Tainted reports whether the watchdog has detected out-of-band
+// modification of the plugin tree since the last verified update.
+func Tainted() bool {
+	snapshotMu.RLock()
+	defer snapshotMu.RUnlock()
+	return tainted
+}
+
+// RunPlugin runs cmd, refusing to do so if the watchdog has flagged the
+// plugin tree as tainted since the last verified update. Anything that
+// executes a plugin script should go through this instead of calling
+// cmd.Run directly, so tampering actually blocks execution rather than
+// just being reported.
+func RunPlugin(cmd *exec.Cmd) error {
+	if Tainted() {
+		return fmt.Errorf("plugin tree is tainted (unverified modification detected), refusing to run %s until the next verified update", cmd.Path)
+	}
+	return cmd.Run()
+}
+
+func setCurrentSnapshot(s Snapshot) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	currentSnap = s
+	tainted = false
+}
+
+// SyncPlugin periodically fetches and diffs the tree of the commit at HEAD
+// against the tree of the remote's target ref, re-materializing only the
+// files that differ between the two rather than doing a full
+// `git reset --hard`, which on a large plugin repo invalidates every
+// script's mtime and re-triggers scheduler work that didn't need to run.
+// The worktree itself is not compared against the snapshot: a locally
+// edited file whose content is the same at HEAD and at the target ref is
+// left as it is.
+func SyncPlugin(ctx context.Context, interval time.Duration) error {
+	cfg := g.Config().Plugin
+	if !cfg.Enabled {
+		return fmt.Errorf("plugin not enabled")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := syncOnce(cfg); err != nil {
+				log.Println("SyncPlugin:", err.Error())
+				reportFailure("sync-fail", err.Error())
+			}
+		}
+	}
+}
+
+func syncOnce(cfg g.PluginConfig) error {
+	tamperSyncLock.Lock()
+	defer tamperSyncLock.Unlock()
+
+	repo, err := pluginRepo()
+	if err != nil {
+		return err
+	}
+
+	fetchCtx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	if err := repo.Fetch(fetchCtx); err != nil {
+		return err
+	}
+
+	target := cfg.TargetRef
+	if target == "" {
+		target = "origin/master"
+	}
+
+	targetHash, err := repo.Resolve(target)
+	if err != nil {
+		return fmt.Errorf("can't resolve target ref %q: %s", target, err)
+	}
+	if len(cfg.SigningKeys) > 0 {
+		keys := cfg.SigningKeys
+		if cfg.AltSigningKeysFile != "" {
+			if altKeys, err := getAltSigningKeys(repo, targetHash.String(), cfg.AltSigningKeysFile, cfg.SigningKeys); err == nil {
+				keys = append(altKeys, cfg.SigningKeys...)
+			}
+		}
+		if err := verifySignature(repo, targetHash.String(), keys); err != nil {
+			return err
+		}
+	}
+	targetCommit, err := repo.repo.CommitObject(targetHash)
+	if err != nil {
+		return err
+	}
+	targetTree, err := targetCommit.Tree()
+	if err != nil {
+		return err
+	}
+
+	headHash, err := repo.Resolve("HEAD")
+	if err != nil {
+		// No commits checked out yet; fall back to a full checkout.
+		if err := repo.Checkout(target); err != nil {
+			return err
+		}
+	} else {
+		headCommit, err := repo.repo.CommitObject(headHash)
+		if err != nil {
+			return err
+		}
+		headTree, err := headCommit.Tree()
+		if err != nil {
+			return err
+		}
+
+		changes, err := headTree.Diff(targetTree)
+		if err != nil {
+			return err
+		}
+		if err := applyChanges(cfg.CheckoutPath, changes); err != nil {
+			return err
+		}
+		if err := repo.SetHead(targetHash); err != nil {
+			return err
+		}
+	}
+
+	snap, err := snapshotAfterCheckout(cfg.CheckoutPath)
+	if err != nil {
+		return err
+	}
+	setCurrentSnapshot(snap)
+	return nil
+}
+
+// applyChanges re-materializes only the files that differ between the
+// current HEAD tree and the target tree, instead of resetting the whole
+// worktree.
+func applyChanges(checkoutPath string, changes object.Changes) error {
+	for _, change := range changes {
+		_, to, err := change.Files()
+		if err != nil {
+			return err
+		}
+
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		target := filepath.Join(checkoutPath, name)
+
+		if to == nil {
+			os.Remove(target)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		r, err := to.Reader()
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		_, err = io.Copy(out, r)
+		r.Close()
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchPlugin starts an fsnotify watchdog on the plugin tree and surfaces
+// out-of-band tampering as a metric. It refuses (via Tainted) to let
+// modified plugins run until the next verified update replaces the
+// snapshot.
+func WatchPlugin(ctx context.Context) error {
+	cfg := g.Config().Plugin
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = filepath.Walk(cfg.CheckoutPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return watcher.Add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-watcher.Events:
+			checkTamper(cfg.CheckoutPath, event.Name)
+		case err := <-watcher.Errors:
+			log.Println("plugin watchdog error:", err.Error())
+		}
+	}
+}
+
+func checkTamper(checkoutPath, changedPath string) {
+	tamperSyncLock.Lock()
+	defer tamperSyncLock.Unlock()
+
+	rel, err := filepath.Rel(checkoutPath, changedPath)
+	if err != nil || rel == snapshotFileName {
+		return
+	}
+
+	snapshotMu.RLock()
+	expected, known := currentSnap[rel]
+	snapshotMu.RUnlock()
+
+	info, err := os.Stat(changedPath)
+	if err != nil {
+		if known {
+			flagTamper(rel, "file removed")
+		}
+		return
+	}
+	if info.IsDir() {
+		return
+	}
+
+	sum, err := sha256File(changedPath)
+	if err != nil {
+		return
+	}
+	got := hex.EncodeToString(sum[:])
+	if !known || got != expected.SHA256 {
+		flagTamper(rel, "content changed outside of a verified update")
+	}
+}
+
+func flagTamper(rel, reason string) {
+	snapshotMu.Lock()
+	tainted = true
+	snapshotMu.Unlock()
+
+	reportFailure("tamper", fmt.Sprintf("%s: %s", rel, reason))
+}
+
+// SnapshotHandler serves the current plugin snapshot as JSON so a central
+// controller can audit what code every agent is actually running.
+func SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	snapshotMu.RLock()
+	snap := currentSnap
+	snapshotMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
@@ -0,0 +1,555 @@
+package plugins
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/agl/ed25519"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/toolkits/file"
+
+	"github.com/leancloud/satori/agent/g"
+)
+
+// Manifest is the metadata blob every non-git Source publishes alongside its
+// artifact, so UpdatePlugin can verify what it downloaded before swapping it
+// into place.
+type Manifest struct {
+	Version     string `json:"version"`
+	ArtifactURL string `json:"artifact_url"`
+	SHA256      string `json:"sha256"`
+	Ed25519Sig  string `json:"ed25519_sig"`
+}
+
+// Bundle is a downloaded, not-yet-verified plugin artifact sitting on disk.
+type Bundle struct {
+	Manifest Manifest
+	Path     string // local path to the downloaded artifact (tarball/zip)
+}
+
+// Source fetches a versioned plugin bundle from somewhere other than (or
+// including) a git remote.
+type Source interface {
+	Fetch(ctx context.Context, version string) (*Bundle, error)
+}
+
+// sourceForConfig picks the Source implementation driven by Plugin.SourceURL,
+// e.g. "s3://bucket/prefix", "gs://bucket/prefix" or "https://.../manifest.json".
+// An empty SourceURL preserves the existing git-based update path.
+func sourceForConfig(cfg g.PluginConfig) (Source, error) {
+	if cfg.SourceURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.SourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Plugin.SourceURL %q: %s", cfg.SourceURL, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return &s3Source{bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+	case "gs":
+		return &gcsSource{bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+	case "http", "https":
+		return &httpSource{manifestURL: cfg.SourceURL}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Plugin.SourceURL scheme %q", u.Scheme)
+	}
+}
+
+// httpSource fetches a manifest.json (and the artifact it points at) over
+// plain HTTPS.
+type httpSource struct {
+	manifestURL string
+}
+
+func (s *httpSource) Fetch(ctx context.Context, version string) (*Bundle, error) {
+	manifestURL := s.manifestURL
+	if !strings.HasSuffix(manifestURL, ".json") {
+		manifestURL = strings.TrimRight(manifestURL, "/") + "/" + version + "/manifest.json"
+	}
+
+	var m Manifest
+	if err := fetchJSON(ctx, manifestURL, &m); err != nil {
+		return nil, fmt.Errorf("can't fetch manifest %s: %s", manifestURL, err)
+	}
+
+	artifactPath, err := downloadToTemp(ctx, m.ArtifactURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't download artifact %s: %s", m.ArtifactURL, err)
+	}
+
+	return &Bundle{Manifest: m, Path: artifactPath}, nil
+}
+
+// s3Source fetches a manifest.json and artifact from an S3 bucket/prefix
+// using the AWS SDK rather than net/http, since "s3://..." isn't a URL
+// scheme http.Client understands.
+type s3Source struct {
+	bucket string
+	prefix string
+}
+
+func (s *s3Source) Fetch(ctx context.Context, version string) (*Bundle, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("can't create AWS session: %s", err)
+	}
+	client := s3.New(sess)
+
+	key := path.Join(s.prefix, version, "manifest.json")
+	var m Manifest
+	if err := fetchS3JSON(ctx, client, s.bucket, key, &m); err != nil {
+		return nil, fmt.Errorf("can't fetch manifest s3://%s/%s: %s", s.bucket, key, err)
+	}
+
+	artifactPath, err := fetchArtifact(ctx, m.ArtifactURL, func(artifactKey string) (io.ReadCloser, error) {
+		return getS3Object(ctx, client, s.bucket, artifactKey)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't download artifact %s: %s", m.ArtifactURL, err)
+	}
+
+	return &Bundle{Manifest: m, Path: artifactPath}, nil
+}
+
+// gcsSource fetches a manifest.json and artifact from a GCS bucket/prefix
+// using the Cloud Storage client, for the same reason s3Source doesn't use
+// net/http directly.
+type gcsSource struct {
+	bucket string
+	prefix string
+}
+
+func (s *gcsSource) Fetch(ctx context.Context, version string) (*Bundle, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't create GCS client: %s", err)
+	}
+	defer client.Close()
+	bucket := client.Bucket(s.bucket)
+
+	key := path.Join(s.prefix, version, "manifest.json")
+	var m Manifest
+	if err := fetchGCSJSON(ctx, bucket, key, &m); err != nil {
+		return nil, fmt.Errorf("can't fetch manifest gs://%s/%s: %s", s.bucket, key, err)
+	}
+
+	artifactPath, err := fetchArtifact(ctx, m.ArtifactURL, func(artifactKey string) (io.ReadCloser, error) {
+		return bucket.Object(artifactKey).NewReader(ctx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't download artifact %s: %s", m.ArtifactURL, err)
+	}
+
+	return &Bundle{Manifest: m, Path: artifactPath}, nil
+}
+
+// fetchArtifact resolves m.ArtifactURL to a download: a plain http(s) URL is
+// fetched directly (the common case, since most manifests hand back a
+// signed HTTPS URL for the artifact), while a bucket-relative key is opened
+// via openObject, the caller's object-store-specific reader.
+func fetchArtifact(ctx context.Context, artifactURL string, openObject func(key string) (io.ReadCloser, error)) (string, error) {
+	if strings.HasPrefix(artifactURL, "http://") || strings.HasPrefix(artifactURL, "https://") {
+		return downloadToTemp(ctx, artifactURL)
+	}
+
+	r, err := openObject(artifactURL)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return writeToTemp(r)
+}
+
+func fetchS3JSON(ctx context.Context, client *s3.S3, bucket, key string, v interface{}) error {
+	r, err := getS3Object(ctx, client, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func getS3Object(ctx context.Context, client *s3.S3, bucket, key string) (io.ReadCloser, error) {
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func fetchGCSJSON(ctx context.Context, bucket *storage.BucketHandle, key string, v interface{}) error {
+	r, err := bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func fetchJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func downloadToTemp(ctx context.Context, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return writeToTemp(resp.Body)
+}
+
+// writeToTemp copies r into a freshly created temp file and returns its
+// path, cleaning up on error.
+func writeToTemp(r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile("", "satori-plugin-bundle-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// verifyBundle checks the downloaded artifact's sha256 against the
+// manifest, then verifies the manifest's ed25519 signature over that
+// sha256, trying each configured signing key in turn.
+func verifyBundle(b *Bundle, validKeys []string) error {
+	sum, err := sha256File(b.Path)
+	if err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(sum[:])
+
+	if digest != b.Manifest.SHA256 {
+		return fmt.Errorf("sha256 mismatch: manifest says %s, artifact is %s", b.Manifest.SHA256, digest)
+	}
+
+	if len(validKeys) == 0 {
+		log.Println("Signing keys not configured, bundle signature verification skipped")
+		return nil
+	}
+
+	return verifyDigestSignature(digest, b.Manifest.Ed25519Sig, validKeys)
+}
+
+// verifyDigestSignature checks sigB64 as an ed25519 signature over digestHex,
+// trying each configured key until one validates.
+func verifyDigestSignature(digestHex, sigB64 string, validKeys []string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("can't decode signature: %s", err)
+	}
+	var sig [64]byte
+	copy(sig[:], sigBytes)
+
+	for _, k := range validKeys {
+		keyStr := strings.Fields(k)[0]
+		keyBytes, err := base64.StdEncoding.DecodeString(keyStr)
+		if err != nil {
+			continue
+		}
+		var vk [32]byte
+		copy(vk[:], keyBytes)
+		if ed25519.Verify(&vk, []byte(digestHex), &sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature invalid or signing key untrusted")
+}
+
+func sha256File(p string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(p)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// extractBundle unpacks the tarball or zip at archivePath into a fresh temp
+// directory created under stagingParent and returns its path. stagingParent
+// should be the parent of Plugin.CheckoutPath (not the system temp dir, which
+// is commonly a different filesystem/mount) so that swapInBundle's final
+// rename into CheckoutPath is a same-filesystem, atomic rename rather than
+// one that can fail with EXDEV.
+func extractBundle(archivePath, stagingParent string) (string, error) {
+	dir, err := ioutil.TempDir(stagingParent, "satori-plugin-extract-")
+	if err != nil {
+		return "", err
+	}
+
+	if zr, zerr := zip.OpenReader(archivePath); zerr == nil {
+		zr.Close()
+		err = extractZip(archivePath, dir)
+	} else {
+		err = extractTarGz(archivePath, dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// safeJoin joins dir and name, rejecting any name (absolute, or containing
+// ".." components) that would resolve outside of dir. Archive entries are
+// untrusted input, so extractors must not let one write outside the
+// extraction directory (Zip Slip).
+func safeJoin(dir, name string) (string, error) {
+	target := filepath.Join(dir, name)
+	if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry %q escapes extraction directory", name)
+	}
+	return target, nil
+}
+
+func extractTarGz(archivePath, dir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
+
+func extractZip(archivePath, dir string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target, err := safeJoin(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, f.Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(out, src)
+		src.Close()
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateViaSource drives the non-git update path: fetch the manifest +
+// artifact from src, verify it, extract it, and atomically swap it into
+// Plugin.CheckoutPath.
+func updateViaSource(src Source, ver string) error {
+	cfg := g.Config().Plugin
+
+	updateInflight = true
+	defer func() { updateInflight = false }()
+	lastPluginUpdate = time.Now().Unix()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	if ver == "" {
+		ver = "latest"
+	}
+
+	bundle, err := src.Fetch(ctx, ver)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle.Path)
+
+	if err := verifyBundle(bundle, cfg.SigningKeys); err != nil {
+		return err
+	}
+
+	stagingParent := path.Dir(cfg.CheckoutPath)
+	if !file.IsExist(stagingParent) {
+		if err := os.MkdirAll(stagingParent, os.ModePerm); err != nil {
+			return fmt.Errorf("can't create %s: %s", stagingParent, err)
+		}
+	}
+
+	extractedDir, err := extractBundle(bundle.Path, stagingParent)
+	if err != nil {
+		return fmt.Errorf("can't extract bundle: %s", err)
+	}
+
+	if err := swapInBundle(cfg.CheckoutPath, extractedDir); err != nil {
+		os.RemoveAll(extractedDir)
+		return err
+	}
+
+	if err := writeVersionMarker(cfg.CheckoutPath, bundle.Manifest.Version); err != nil {
+		log.Println("can't write plugin version marker:", err.Error())
+	}
+
+	log.Println("Update plugins (bundle source) complete, version", bundle.Manifest.Version)
+	return nil
+}
+
+// versionMarkerName records which manifest version is currently checked out
+// at CheckoutPath for non-git sources, which (unlike a git checkout) have no
+// ref of their own for GetCurrentPluginVersion to read.
+const versionMarkerName = ".satori-version"
+
+func writeVersionMarker(checkoutPath, version string) error {
+	return ioutil.WriteFile(filepath.Join(checkoutPath, versionMarkerName), []byte(version), 0644)
+}
+
+func readVersionMarker(checkoutPath string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(checkoutPath, versionMarkerName))
+	if err != nil {
+		return "", fmt.Errorf("can't read plugin version marker: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// swapInBundle atomically replaces checkoutPath with the extracted bundle at
+// newPath, keeping the previous version at checkoutPath+".prev" for
+// rollback.
+func swapInBundle(checkoutPath, newPath string) error {
+	prevPath := checkoutPath + ".prev"
+	hadPrevious := false
+
+	if file.IsExist(prevPath) {
+		if err := os.RemoveAll(prevPath); err != nil {
+			return fmt.Errorf("can't clear previous bundle %s: %s", prevPath, err)
+		}
+	}
+
+	if file.IsExist(checkoutPath) {
+		if err := os.Rename(checkoutPath, prevPath); err != nil {
+			return fmt.Errorf("can't retain previous bundle: %s", err)
+		}
+		hadPrevious = true
+	}
+
+	if err := os.Rename(newPath, checkoutPath); err != nil {
+		// Restore the previous version rather than leaving checkoutPath
+		// missing entirely when this rename fails even though the
+		// preceding one succeeded.
+		if hadPrevious {
+			if rerr := os.Rename(prevPath, checkoutPath); rerr != nil {
+				return fmt.Errorf("can't swap in new bundle (%s) and couldn't restore previous version (%s)", err, rerr)
+			}
+		}
+		return fmt.Errorf("can't swap in new bundle: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSigMagic is the fixed preamble of an openssh SSHSIG blob, per
+// PROTOCOL.sshsig.
+const sshSigMagic = "SSHSIG"
+
+// verifySSHSignature verifies a git commit signed with `gpg.format=ssh`
+// (git's gpgsig header containing an "-----BEGIN SSH SIGNATURE-----" armor
+// block), checking the signer against allowedSignersFile.
+func verifySSHSignature(content string, allowedSignersFile string) error {
+	armored, payload, found := extractHeaderBlock(content, "gpgsig")
+	if !found {
+		return fmt.Errorf("no gpgsig header present")
+	}
+	if !strings.Contains(armored, "BEGIN SSH SIGNATURE") {
+		return fmt.Errorf("gpgsig header is not an SSH signature")
+	}
+
+	blob, err := decodeArmoredSSHSig(armored)
+	if err != nil {
+		return err
+	}
+
+	sig, err := parseSSHSigBlob(blob)
+	if err != nil {
+		return err
+	}
+
+	if sig.namespace != "git" {
+		return fmt.Errorf("unexpected SSHSIG namespace %q, want \"git\"", sig.namespace)
+	}
+
+	pubKey, err := ssh.ParsePublicKey(sig.publicKey)
+	if err != nil {
+		return fmt.Errorf("can't parse SSH public key from signature: %s", err)
+	}
+
+	if allowedSignersFile == "" {
+		return fmt.Errorf("Plugin.AllowedSignersFile not configured, refusing to trust an unverified ssh key")
+	}
+	allowed, err := isAllowedSigner(allowedSignersFile, pubKey)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("ssh key %s is not in %s", ssh.FingerprintSHA256(pubKey), allowedSignersFile)
+	}
+
+	digest, err := hashPayload(sig.hashAlgorithm, payload)
+	if err != nil {
+		return err
+	}
+
+	signedMessage := []byte(sshSigMagic)
+	signedMessage = append(signedMessage, sshString(sig.namespace)...)
+	signedMessage = append(signedMessage, sshString("")...) // reserved
+	signedMessage = append(signedMessage, sshString(sig.hashAlgorithm)...)
+	signedMessage = append(signedMessage, sshString(string(digest))...)
+
+	sshSignature := &ssh.Signature{Format: sig.sigFormat, Blob: sig.sigBlob}
+	if err := pubKey.Verify(signedMessage, sshSignature); err != nil {
+		return fmt.Errorf("ssh signature verification failed: %s", err)
+	}
+	return nil
+}
+
+type parsedSSHSig struct {
+	publicKey     []byte
+	namespace     string
+	hashAlgorithm string
+	sigFormat     string
+	sigBlob       []byte
+}
+
+// decodeArmoredSSHSig strips the PEM-style armor around an openssh SSHSIG
+// and base64-decodes the body into the raw SSHSIG blob.
+func decodeArmoredSSHSig(armored string) ([]byte, error) {
+	var b strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(armored))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return base64.StdEncoding.DecodeString(b.String())
+}
+
+// parseSSHSigBlob decodes the binary SSHSIG format:
+//
+//	magic "SSHSIG", uint32 version, string publickey, string namespace,
+//	string reserved, string hash_algorithm, string signature
+//
+// where "signature" is itself an SSH wire-format signature (string format,
+// string blob).
+func parseSSHSigBlob(blob []byte) (*parsedSSHSig, error) {
+	if len(blob) < len(sshSigMagic) || string(blob[:len(sshSigMagic)]) != sshSigMagic {
+		return nil, fmt.Errorf("not an SSHSIG blob (bad magic)")
+	}
+	r := blob[len(sshSigMagic):]
+
+	var version uint32
+	var pubKey, namespace, reserved, hashAlg, signature []byte
+	var err error
+
+	if version, r, err = readUint32(r); err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported SSHSIG version %d", version)
+	}
+	if pubKey, r, err = readSSHString(r); err != nil {
+		return nil, err
+	}
+	if namespace, r, err = readSSHString(r); err != nil {
+		return nil, err
+	}
+	if reserved, r, err = readSSHString(r); err != nil {
+		return nil, err
+	}
+	_ = reserved
+	if hashAlg, r, err = readSSHString(r); err != nil {
+		return nil, err
+	}
+	if signature, _, err = readSSHString(r); err != nil {
+		return nil, err
+	}
+
+	sigFormat, sigBlob, err := readSSHString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsedSSHSig{
+		publicKey:     pubKey,
+		namespace:     string(namespace),
+		hashAlgorithm: string(hashAlg),
+		sigFormat:     string(sigFormat),
+		sigBlob:       sigBlob,
+	}, nil
+}
+
+func readUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("truncated SSHSIG blob")
+	}
+	v := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	return v, b[4:], nil
+}
+
+func readSSHString(b []byte) ([]byte, []byte, error) {
+	n, rest, err := readUint32(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(rest)) < n {
+		return nil, nil, fmt.Errorf("truncated SSHSIG blob")
+	}
+	return rest[:n], rest[n:], nil
+}
+
+// sshString encodes s as an SSH wire-format string: a uint32 length prefix
+// followed by the raw bytes.
+func sshString(s string) []byte {
+	n := len(s)
+	out := make([]byte, 4+n)
+	out[0] = byte(n >> 24)
+	out[1] = byte(n >> 16)
+	out[2] = byte(n >> 8)
+	out[3] = byte(n)
+	copy(out[4:], s)
+	return out
+}
+
+func hashPayload(alg string, payload string) ([]byte, error) {
+	var h hash.Hash
+	switch strings.ToLower(alg) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSHSIG hash algorithm %q", alg)
+	}
+	h.Write([]byte(payload))
+	return h.Sum(nil), nil
+}
+
+// isAllowedSigner checks pubKey against the authorized-keys-style key entry
+// on every line of an `allowed_signers` file, in the
+// format documented by ssh-keygen(1)'s -Y verify / AllowedSignersFile.
+func isAllowedSigner(allowedSignersFile string, pubKey ssh.PublicKey) (bool, error) {
+	data, err := ioutil.ReadFile(allowedSignersFile)
+	if err != nil {
+		return false, fmt.Errorf("can't read allowed_signers file %s: %s", allowedSignersFile, err)
+	}
+
+	want := pubKey.Marshal()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// fields[0] is the comma-separated principal (optionally followed
+		// by cert-authority/namespaces=... options in fields[1]); the
+		// remainder is a standard authorized_keys-style "keytype base64
+		// [comment]" entry that ParseAuthorizedKey understands as a whole,
+		// not field-by-field.
+		for i := 1; i < len(fields) && i <= 2; i++ {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(key.Marshal(), want) {
+				return true, nil
+			}
+			break
+		}
+	}
+	return false, nil
+}
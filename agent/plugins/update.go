@@ -1,24 +1,17 @@
 package plugins
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/agl/ed25519"
 
-	"github.com/kardianos/osext"
 	"github.com/leancloud/satori/agent/g"
 	"github.com/leancloud/satori/common/model"
 	"github.com/toolkits/file"
@@ -41,6 +34,16 @@ func reportFailure(subject string, desc string) {
 	g.SendToTransfer(m)
 }
 
+// pluginRepo lazily opens/inits the on-disk PluginRepo for cfg.CheckoutPath.
+func pluginRepo() (*PluginRepo, error) {
+	cfg := g.Config().Plugin
+	parentDir := path.Dir(cfg.CheckoutPath)
+	if !file.IsExist(parentDir) {
+		os.MkdirAll(parentDir, os.ModePerm)
+	}
+	return OpenOrInitPluginRepo(cfg.CheckoutPath, cfg.Git)
+}
+
 func GetCurrentPluginVersion() (string, error) {
 	cfg := g.Config().Plugin
 	if !cfg.Enabled {
@@ -53,25 +56,61 @@ func GetCurrentPluginVersion() (string, error) {
 		return "", fmt.Errorf("plugin-dir-does-not-exist")
 	}
 
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = pluginDir
+	src, err := sourceForConfig(cfg)
+	if err != nil {
+		reportFailure("source-config-fail", err.Error())
+		return "", err
+	}
+	if src != nil {
+		ver, err := readVersionMarker(pluginDir)
+		if err != nil {
+			reportFailure("version-marker-fail", err.Error())
+			return "", err
+		}
+		return ver, nil
+	}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	repo, err := OpenOrInitPluginRepo(pluginDir, cfg.Git)
 	if err != nil {
-		reportFailure("git-fail", err.Error()+"\n"+stderr.String())
+		reportFailure("git-fail", err.Error())
 		return "", err
 	}
 
-	return strings.TrimSpace(stdout.String()), nil
+	ver, err := repo.ResolveHead()
+	if err != nil {
+		reportFailure("git-fail", err.Error())
+		return "", err
+	}
+	return ver, nil
 }
 
 var updateInflight bool = false
 var lastPluginUpdate int64 = 0
 
+// minUpdateIntervalOverride lets a controller-driven caller set the
+// UpdatePlugin throttle from the pin it was handed (Pin.MinUpdateInterval)
+// instead of the fixed 300s default, so a coordinator can tune it without
+// an agent restart. <= 0 means "no override, use Plugin.MinUpdateInterval
+// or the 300s default".
+var minUpdateIntervalOverride int64 = 0
+
+// SetMinUpdateInterval overrides, in seconds, how often UpdatePlugin will
+// actually attempt an update. Pass 0 to go back to Plugin.MinUpdateInterval
+// / the 300s default.
+func SetMinUpdateInterval(seconds int64) {
+	minUpdateIntervalOverride = seconds
+}
+
+func minUpdateInterval(cfg g.PluginConfig) int64 {
+	if minUpdateIntervalOverride > 0 {
+		return minUpdateIntervalOverride
+	}
+	if cfg.MinUpdateInterval > 0 {
+		return cfg.MinUpdateInterval
+	}
+	return 300
+}
+
 func UpdatePlugin(ver string) error {
 	debug := g.Config().Debug
 	cfg := g.Config().Plugin
@@ -91,8 +130,7 @@ func UpdatePlugin(ver string) error {
 		return fmt.Errorf(s)
 	}
 
-	// TODO: add to config
-	if time.Now().Unix()-lastPluginUpdate < 300 {
+	if time.Now().Unix()-lastPluginUpdate < minUpdateInterval(cfg) {
 		s := "Previous update too recent, do nothing"
 		if debug {
 			log.Println(s)
@@ -100,22 +138,33 @@ func UpdatePlugin(ver string) error {
 		return fmt.Errorf(s)
 	}
 
-	parentDir := path.Dir(cfg.CheckoutPath)
-
-	if !file.IsExist(parentDir) {
-		os.MkdirAll(parentDir, os.ModePerm)
+	src, err := sourceForConfig(cfg)
+	if err != nil {
+		log.Println(err.Error())
+		reportFailure("source-config-fail", err.Error())
+		return err
+	}
+	if src != nil {
+		if err := updateViaSource(src, ver); err != nil {
+			log.Println(err.Error())
+			reportFailure("source-fail", err.Error())
+			return err
+		}
+		return nil
 	}
 
 	if ver == "" {
 		ver = "origin/master"
 	}
 
-	if err := ensureGitRepo(cfg.CheckoutPath, cfg.Git); err != nil {
+	repo, err := pluginRepo()
+	if err != nil {
 		log.Println(err.Error())
 		reportFailure("git-fail", err.Error())
 		return err
 	}
-	if err := updateByFetch(cfg.CheckoutPath); err != nil {
+
+	if err := updateByFetch(repo); err != nil {
 		log.Println(err.Error())
 		reportFailure("git-fail", err.Error())
 		return err
@@ -123,7 +172,7 @@ func UpdatePlugin(ver string) error {
 	if len(cfg.SigningKeys) > 0 {
 		keys := cfg.SigningKeys
 		if cfg.AltSigningKeysFile != "" {
-			altKeys, err := getAltSigningKeys(cfg.CheckoutPath, ver, cfg.AltSigningKeysFile, cfg.SigningKeys)
+			altKeys, err := getAltSigningKeys(repo, ver, cfg.AltSigningKeysFile, cfg.SigningKeys)
 			if err != nil {
 				log.Println("Failed to get alternative signing keys: " + err.Error())
 				reportFailure("alt-key-fail", err.Error())
@@ -136,7 +185,7 @@ func UpdatePlugin(ver string) error {
 				keys = append(altKeys, cfg.SigningKeys...)
 			}
 		}
-		if err := verifySignature(cfg.CheckoutPath, ver, keys); err != nil {
+		if err := verifySignature(repo, ver, keys); err != nil {
 			log.Println(err.Error())
 			reportFailure("signature-fail", err.Error())
 			return err
@@ -145,7 +194,7 @@ func UpdatePlugin(ver string) error {
 		log.Println("Signing keys not configured, signature verification skipped")
 	}
 
-	if err := checkoutCommit(cfg.CheckoutPath, ver); err != nil {
+	if err := checkoutCommit(repo, ver); err != nil {
 		log.Println(err.Error())
 		reportFailure("git-fail", err.Error())
 		return err
@@ -154,68 +203,59 @@ func UpdatePlugin(ver string) error {
 	return nil
 }
 
-func ensureGitRepo(path string, remote string) error {
-	var buf bytes.Buffer
-
-	if !file.IsExist(path) {
-		log.Println("Plugin repo does not exist, creating one")
-		buf.Reset()
-		cmd := exec.Command("git", "init", path)
-		cmd.Stdout = &buf
-		cmd.Stderr = &buf
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("Can't init plugin repo: %s\n%s", err, buf.String())
-		}
-
-		buf.Reset()
-		cmd = exec.Command("git", "remote", "add", "origin", remote)
-		cmd.Dir = path
-		cmd.Stdout = &buf
-		cmd.Stderr = &buf
-		err = cmd.Run()
-		if err != nil {
-			os.RemoveAll(path)
-			return fmt.Errorf("Can't set repo remote, aborting: %s", err)
-		}
-	}
-
-	return nil
-}
-
-func updateByFetch(path string) error {
-	var buf bytes.Buffer
-
+func updateByFetch(repo *PluginRepo) error {
 	log.Println("Begin update plugins")
 	updateInflight = true
 	defer func() { updateInflight = false }()
 	lastPluginUpdate = time.Now().Unix()
 
-	buf.Reset()
-	cmd := exec.Command("timeout", "120s", "git", "fetch")
-	cmd.Dir = path
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("Update plugins by fetch error: %s\n%s", err, buf.String())
-	}
-	return nil
-}
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
 
-func verifySignature(checkoutPath string, head string, validKeys []string) error {
-	var buf bytes.Buffer
-	var err error
+	return repo.Fetch(ctx)
+}
 
-	cmd := exec.Command("git", "cat-file", "-p", head)
-	cmd.Dir = checkoutPath
-	cmd.Stdout = &buf
-	err = cmd.Run()
+// verifySignature checks head's commit signature against validKeys, trying
+// each of Plugin.SignatureModes in turn (defaulting to the legacy
+// "satori"-only trailer when unset) and succeeding if any one of them
+// verifies. This lets sites keep using the custom satori-sign trailer while
+// new ones sign commits normally with `git commit -S` (PGP or SSH).
+func verifySignature(repo *PluginRepo, head string, validKeys []string) error {
+	content, err := repo.CatObject(head)
 	if err != nil {
-		return fmt.Errorf("Can't get content of desired commit: %s\n%s", err, buf.String())
+		return err
 	}
-	content := buf.String()
 
+	cfg := g.Config().Plugin
+	modes := cfg.SignatureModes
+	if len(modes) == 0 {
+		modes = []string{"satori"}
+	}
+
+	var errs []string
+	for _, mode := range modes {
+		var verr error
+		switch mode {
+		case "satori":
+			verr = verifySatoriSignature(content, validKeys)
+		case "ssh":
+			verr = verifySSHSignature(content, cfg.AllowedSignersFile)
+		case "pgp":
+			verr = verifyPGPSignature(content, cfg.GPGKeyring)
+		default:
+			verr = fmt.Errorf("unknown signature mode %q", mode)
+		}
+		if verr == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", mode, verr))
+	}
+	return fmt.Errorf("no configured signature mode succeeded: %s", strings.Join(errs, "; "))
+}
+
+// verifySatoriSignature checks the legacy custom commit trailer
+// "satori-sign <keyid>:<base64 ed25519 sig over the tree hash>".
+func verifySatoriSignature(content string, validKeys []string) error {
 	tree := ""
 	key := ""
 	sign := ""
@@ -227,6 +267,9 @@ func verifySignature(checkoutPath string, head string, validKeys []string) error
 		if strings.HasPrefix(l, "satori-sign ") {
 			s := strings.TrimSpace(l[len("satori-sign "):])
 			a := strings.Split(s, ":")
+			if len(a) < 2 {
+				return fmt.Errorf("malformed satori-sign trailer %q", s)
+			}
 			keyid := a[0]
 			for _, k := range validKeys {
 				if strings.HasPrefix(k, keyid) {
@@ -248,6 +291,7 @@ func verifySignature(checkoutPath string, head string, validKeys []string) error
 
 	var vkslice []byte
 	var vk [32]byte
+	var err error
 	if vkslice, err = base64.StdEncoding.DecodeString(key); err != nil {
 		return err
 	}
@@ -267,34 +311,22 @@ func verifySignature(checkoutPath string, head string, validKeys []string) error
 	return nil
 }
 
-func getAltSigningKeys(checkoutPath string, head string, keyFile string, validKeys []string) ([]string, error) {
-	fullPath := path.Join(checkoutPath, keyFile)
-	if !file.IsExist(fullPath) {
-		return nil, fmt.Errorf("keyFile %s does not exist", fullPath)
-	}
-
-	var buf bytes.Buffer
-	var err error
-
-	cmd := exec.Command("git", "rev-list", "-1", head, keyFile)
-	cmd.Dir = checkoutPath
-	cmd.Stdout = &buf
-	err = cmd.Run()
+func getAltSigningKeys(repo *PluginRepo, head string, keyFile string, validKeys []string) ([]string, error) {
+	mostRecentHash, err := repo.LastCommitTouching(head, keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("Can't get most recent commit hash of key file: %s\n%s", err, buf.String())
+		return nil, fmt.Errorf("Can't get most recent commit hash of key file: %s", err)
 	}
-	mostRecentHash := strings.TrimSpace(buf.String())
-	if err = verifySignature(checkoutPath, mostRecentHash, validKeys); err != nil {
+	if err = verifySignature(repo, mostRecentHash, validKeys); err != nil {
 		return nil, err
 	}
 
-	content, err := ioutil.ReadFile(fullPath)
+	content, err := repo.FileAt(mostRecentHash, keyFile)
 	if err != nil {
 		return nil, err
 	}
 
 	lst := make([]string, 0, 5)
-	for _, l := range strings.Split(string(content), "\n") {
+	for _, l := range strings.Split(content, "\n") {
 		l = strings.TrimSpace(l)
 		if strings.HasPrefix(l, "#") || l == "" {
 			continue
@@ -305,17 +337,17 @@ func getAltSigningKeys(checkoutPath string, head string, keyFile string, validKe
 	return lst, nil
 }
 
-func checkoutCommit(checkoutPath string, head string) error {
-	var buf bytes.Buffer
+func checkoutCommit(repo *PluginRepo, head string) error {
+	if err := repo.Checkout(head); err != nil {
+		return err
+	}
 
-	cmd := exec.Command("git", "reset", "--hard", head)
-	cmd.Dir = checkoutPath
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
-	err := cmd.Run()
+	snap, err := snapshotAfterCheckout(repo.path)
 	if err != nil {
-		return fmt.Errorf("git reset --hard failed: %s\n%s", err, buf.String())
+		log.Println("can't snapshot plugin tree after checkout:", err.Error())
+		return nil
 	}
+	setCurrentSnapshot(snap)
 	return nil
 }
 
@@ -326,93 +358,27 @@ func ForceResetPlugin() error {
 	}
 
 	dir := cfg.CheckoutPath
-
-	if file.IsExist(dir) {
-		var buf bytes.Buffer
-		cmd := exec.Command("git", "reset", "--hard")
-		cmd.Dir = dir
-		cmd.Stdout = &buf
-		cmd.Stderr = &buf
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("git reset --hard failed: %s\n%s", err, buf.String())
-		}
-	}
-	return nil
-}
-
-func TrySelfUpdate() error {
-	debug := g.Config().Debug
-	cfg := g.Config()
-	if !cfg.SelfUpdate {
+	if !file.IsExist(dir) {
 		return nil
 	}
 
-	h := sha256.New()
-	var err error
-	selfPath, err := osext.Executable()
+	src, err := sourceForConfig(cfg)
 	if err != nil {
 		return err
 	}
-
-	newPath := path.Join(cfg.Plugin.CheckoutPath, "satori-agent")
-	if !file.IsExist(newPath) {
-		if debug {
-			log.Println("SelfUpdate: Can't find new binary on path:", newPath)
-		}
-		return nil
+	if src != nil {
+		return fmt.Errorf("ForceResetPlugin is not supported with Plugin.SourceURL configured; run UpdatePlugin to re-fetch a verified bundle instead")
 	}
 
-	h.Reset()
-	self, err := os.Open(selfPath)
+	repo, err := OpenOrInitPluginRepo(dir, cfg.Git)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(h, self); err != nil {
-		return err
-	}
-	self.Close()
-	selfHash := h.Sum(nil)
 
-	h.Reset()
-	new, err := os.Open(newPath)
+	head, err := repo.ResolveHead()
 	if err != nil {
-		return err
-	}
-	if _, err := io.Copy(h, new); err != nil {
-		return err
-	}
-	new.Close()
-	newHash := h.Sum(nil)
-
-	if bytes.Equal(selfHash, newHash) {
-		return nil
-	}
-
-	script := fmt.Sprintf(
-		"SELF=\"%s\"\nRENAME=\"%s\"\nNEW=\"%s\"\n",
-		selfPath, selfPath+"."+hex.EncodeToString(selfHash), newPath,
-	)
-
-	script += `
-	set -e
-	if [ ! -f "$NEW" ]; then
-		exit 1
-	fi
-	if [ -f "$RENAME" ]; then
-		rm -f $RENAME
-	fi
-	mv $SELF $RENAME
-	cp -a $NEW $SELF
-	`
-
-	cmd := exec.Command("bash", "-c", script)
-	if err := cmd.Run(); err != nil {
-		return err
+		return fmt.Errorf("git reset --hard failed: %s", err)
 	}
 
-	log.Println("SelfUpdate triggered, restarting")
-	syscall.Exec(selfPath, os.Args, os.Environ())
-
-	return fmt.Errorf("Can't do exec!")
+	return repo.Checkout(head)
 }